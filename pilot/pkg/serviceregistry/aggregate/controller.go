@@ -0,0 +1,616 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aggregate implements a service discovery that aggregates several
+// service registries, merging the results of each into a unified view.
+package aggregate
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+)
+
+var scope = log.RegisterScope("aggregate", "aggregate registry", 0)
+
+var (
+	_ model.ServiceDiscovery = &Controller{}
+	_ model.Controller       = &Controller{}
+)
+
+// Controller aggregates data across different registries and monitors for changes.
+// It is used to merge registry specific service objects and push them through the
+// context to the config generation code that does the actual generation.
+type Controller struct {
+	meshHolder model.MeshConfigHolder
+
+	registryListMutex sync.RWMutex
+	registries        []*registryEntry
+	// generation is bumped under registryListMutex every time c.registries is
+	// mutated, and handed to serviceIndex.rebuild so that a rebuild kicked off
+	// against a stale registry list can't clobber one started against a newer
+	// list if the two finish out of order (see addRegistryLocked/DeleteRegistry).
+	generation uint64
+	index      *serviceIndex
+	events     *eventBus
+	running    bool
+}
+
+// registryEntry wraps a registered Instance. It exists so that, over time,
+// the aggregate controller can track bookkeeping for a given registry
+// (e.g. whether it has been started) without changing the Instance interface.
+type registryEntry struct {
+	serviceregistry.Instance
+}
+
+// Options stores the configurable attributes of a Controller.
+type Options struct {
+	MeshHolder model.MeshConfigHolder
+
+	// ExtenderConfigs describes out-of-process HTTP(S) service registries to
+	// wrap as HTTPExtenderRegistry instances and register automatically.
+	ExtenderConfigs []ExtenderConfig
+
+	// EventDebounce bounds how long bursts of same-cluster service-change
+	// events are coalesced before being delivered to Subscribe subscribers.
+	// Zero disables coalescing.
+	EventDebounce time.Duration
+}
+
+// NewController creates a new Controller instance.
+func NewController(opt Options) *Controller {
+	c := &Controller{
+		meshHolder: opt.MeshHolder,
+		registries: make([]*registryEntry, 0),
+		index:      newServiceIndex(),
+		events:     newEventBus(opt.EventDebounce),
+	}
+	for _, extCfg := range opt.ExtenderConfigs {
+		c.AddRegistry(NewHTTPExtenderRegistry(extCfg))
+	}
+	return c
+}
+
+// Subscribe returns a channel of RegistryEvents describing registry
+// membership changes (AddRegistry/AddRegistryAndRun/DeleteRegistry) and
+// member service changes, along with a CancelFunc to stop receiving them.
+// Downstream consumers such as xDS generators can react incrementally
+// instead of polling GetRegistries and re-listing Services.
+//
+// Bursts of same-cluster service-change events are coalesced within the
+// debounce window configured via Options.EventDebounce; membership events are
+// never coalesced, and DeleteRegistry always produces a terminal event for
+// its cluster/provider so subscribers can clean up cluster-scoped state. A
+// subscriber that falls behind has events dropped (and counted in the log)
+// rather than blocking the publisher.
+func (c *Controller) Subscribe() (<-chan RegistryEvent, CancelFunc) {
+	return c.events.subscribe()
+}
+
+// addRegistryLocked appends registry to the aggregate and bumps the
+// generation counter. It does no I/O, so it is safe to call while holding
+// registryListMutex; the (potentially slow) index rebuild is the caller's
+// responsibility, done after releasing the lock - see AddRegistry.
+func (c *Controller) addRegistryLocked(registry serviceregistry.Instance) *registryEntry {
+	entry := &registryEntry{Instance: registry}
+	c.registries = append(c.registries, entry)
+	entry.AppendServiceHandler(func(svc *model.Service, event model.Event) {
+		c.index.onServiceEvent(entry, svc, event)
+		c.events.publishServiceChanged(RegistryEvent{
+			Type:       RegistryServiceChanged,
+			ClusterID:  entry.Cluster(),
+			ProviderID: entry.Provider(),
+			Service:    svc,
+		})
+	})
+	c.generation++
+	return entry
+}
+
+// AddRegistry adds a new registry to the aggregate. If the aggregate controller
+// has already been started (via Run), the registry is NOT started; use
+// AddRegistryAndRun for registries added after startup.
+//
+// The hostname/cluster index rebuild that follows is done after releasing
+// registryListMutex: member registries (e.g. HTTPExtenderRegistry) may block
+// on network I/O in Services(), and doing that under the exclusive lock would
+// stall every concurrent Services()/GetService()/GetProxyServiceInstances()
+// caller - which only need an RLock - for as long as that I/O takes.
+func (c *Controller) AddRegistry(registry serviceregistry.Instance) {
+	c.registryListMutex.Lock()
+	scope.Infof("Adding registry %v", registry.Cluster())
+	entry := c.addRegistryLocked(registry)
+	registries := entriesSlice(c.registries)
+	generation := c.generation
+	c.registryListMutex.Unlock()
+
+	c.index.rebuild(registries, generation)
+	c.events.publish(RegistryEvent{
+		Type:       RegistryAdded,
+		ClusterID:  entry.Cluster(),
+		ProviderID: entry.Provider(),
+	})
+}
+
+// AddRegistryAndRun adds a new registry to the aggregate and, if the aggregate
+// controller has already started, runs it immediately using the provided stop
+// channel. This is used for registries that are discovered dynamically, after
+// Run has already been called (e.g. remote clusters added at runtime).
+func (c *Controller) AddRegistryAndRun(registry serviceregistry.Instance, stop <-chan struct{}) {
+	c.registryListMutex.Lock()
+	entry := c.addRegistryLocked(registry)
+	registries := entriesSlice(c.registries)
+	generation := c.generation
+	running := c.running
+	c.registryListMutex.Unlock()
+
+	c.index.rebuild(registries, generation)
+	c.events.publish(RegistryEvent{
+		Type:       RegistryAdded,
+		ClusterID:  entry.Cluster(),
+		ProviderID: entry.Provider(),
+	})
+
+	if running {
+		if stop == nil {
+			scope.Errorf("AddRegistryAndRun registry %v has no stop channel", registry.Cluster())
+		}
+		go registry.Run(stop)
+	}
+}
+
+// getRegistryIndex returns the index of the registry identified by clusterID and
+// providerID in c.registries. Callers must hold registryListMutex.
+func (c *Controller) getRegistryIndex(clusterID cluster.ID, provider provider.ID) (int, bool) {
+	for i, r := range c.registries {
+		if r.Cluster() == clusterID && r.Provider() == provider {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// DeleteRegistry deletes the registry identified by the given clusterID and
+// providerID. Like AddRegistry, the index rebuild runs after releasing
+// registryListMutex so membership changes don't serialize on a member
+// registry's network I/O.
+func (c *Controller) DeleteRegistry(clusterID cluster.ID, providerID provider.ID) {
+	c.registryListMutex.Lock()
+	if len(c.registries) == 0 {
+		c.registryListMutex.Unlock()
+		scope.Warnf("Registry list is empty, nothing to delete")
+		return
+	}
+	index, ok := c.getRegistryIndex(clusterID, providerID)
+	if !ok {
+		c.registryListMutex.Unlock()
+		scope.Warnf("Registry %s/%s not found, nothing to delete", providerID, clusterID)
+		return
+	}
+	c.registries = append(c.registries[:index], c.registries[index+1:]...)
+	c.generation++
+	registries := entriesSlice(c.registries)
+	generation := c.generation
+	c.registryListMutex.Unlock()
+
+	c.index.rebuild(registries, generation)
+	// Terminal event: always delivered, never debounced, so watchers can
+	// reliably clean up any state scoped to this cluster/provider. Drop any
+	// still-pending coalesced service-change event for this cluster first, so
+	// its timer can't fire afterwards and deliver a stale event once
+	// subscribers have already torn down cluster-scoped state.
+	c.events.dropPending(clusterID)
+	c.events.publish(RegistryEvent{Type: RegistryDeleted, ClusterID: clusterID, ProviderID: providerID})
+	scope.Infof("Registry for %s/%s has been deleted", providerID, clusterID)
+}
+
+// GetRegistries returns a copy of the aggregated registries.
+func (c *Controller) GetRegistries() []serviceregistry.Instance {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	out := make([]serviceregistry.Instance, len(c.registries))
+	for i, r := range c.registries {
+		out[i] = r
+	}
+	return out
+}
+
+// mergeAddresses merges the cluster VIP map of a duplicate service discovered
+// in more than one registry (e.g. a replicated service in several clusters).
+func mergeAddresses(dst, src map[cluster.ID][]string) map[cluster.ID][]string {
+	if dst == nil {
+		dst = make(map[cluster.ID][]string, len(src))
+	}
+	for c, addrs := range src {
+		dst[c] = append(dst[c], addrs...)
+	}
+	return dst
+}
+
+// Services lists services from all attached registries, merging duplicate
+// hostnames from different registries into a single service with the union
+// of their cluster VIPs. The merged result is cached and reused until a
+// member registry reports a service change or registry membership changes.
+func (c *Controller) Services() ([]*model.Service, error) {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	if snap, ok := c.index.getSnapshot(); ok {
+		return snap, nil
+	}
+
+	smap := make(map[host.Name]*model.Service)
+	services := make([]*model.Service, 0)
+	var errs error
+	for _, r := range entriesSlice(c.registries) {
+		svcs, err := r.Services()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		for _, s := range svcs {
+			existing, found := smap[s.Hostname]
+			if !found {
+				// DeepCopy before mutating below, so we never mutate a registry's own service object.
+				merged := s.DeepCopy()
+				smap[s.Hostname] = merged
+				services = append(services, merged)
+				continue
+			}
+			existing.Mutex.Lock()
+			existing.ClusterVIPs.Addresses = mergeAddresses(existing.ClusterVIPs.Addresses, s.ClusterVIPs.Addresses)
+			existing.Mutex.Unlock()
+		}
+	}
+	if errs == nil {
+		c.index.setSnapshot(services)
+	}
+	return services, errs
+}
+
+// GetService retrieves a service by hostname, merging cluster VIPs if the
+// same hostname is present in more than one registry. The lookup jumps
+// directly to the registries the index knows serve hostname, falling back to
+// a full scan only if the index has no record of it yet.
+func (c *Controller) GetService(hostname host.Name) *model.Service {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	regs, ok := c.index.registriesForHost(hostname)
+	if !ok {
+		regs = entriesSlice(c.registries)
+	}
+
+	var out *model.Service
+	for _, r := range regs {
+		svc := r.GetService(hostname)
+		if svc == nil {
+			continue
+		}
+		if out == nil {
+			out = svc.DeepCopy()
+			continue
+		}
+		out.Mutex.Lock()
+		out.ClusterVIPs.Addresses = mergeAddresses(out.ClusterVIPs.Addresses, svc.ClusterVIPs.Addresses)
+		out.Mutex.Unlock()
+	}
+	return out
+}
+
+// GetServiceForProxy behaves like GetService, but additionally scopes the
+// search to registries visible to node's cluster and partition (see
+// PartitionLabel). Callers with proxy context (e.g. xDS generation) should
+// prefer this over GetService to avoid leaking services across tenants.
+func (c *Controller) GetServiceForProxy(hostname host.Name, node *model.Proxy) *model.Service {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	regs, ok := c.index.registriesForHost(hostname)
+	if !ok {
+		regs = entriesSlice(c.registries)
+	}
+	nodePartition := proxyPartition(node)
+
+	var out *model.Service
+	for _, r := range regs {
+		if skipSearchingRegistryForProxyAndPartition(node.Metadata.ClusterID, nodePartition, r.Instance) {
+			continue
+		}
+		svc := r.GetService(hostname)
+		if svc == nil {
+			continue
+		}
+		if out == nil {
+			out = svc.DeepCopy()
+			continue
+		}
+		out.Mutex.Lock()
+		out.ClusterVIPs.Addresses = mergeAddresses(out.ClusterVIPs.Addresses, svc.ClusterVIPs.Addresses)
+		out.Mutex.Unlock()
+	}
+	return out
+}
+
+// skipSearchingRegistryForProxy returns true if the given registry should be
+// skipped when searching for service instances/endpoints for a proxy in the
+// given cluster. Registries serving external services are always searched,
+// as are registries when the proxy's cluster is unknown.
+func skipSearchingRegistryForProxy(nodeClusterID cluster.ID, r serviceregistry.Instance) bool {
+	// If the proxy's cluster is unknown, we cannot filter - search everywhere.
+	if nodeClusterID == "" {
+		return false
+	}
+	// Registries that host external services aren't tied to a particular
+	// workload cluster, so they must always be searched.
+	if r.Provider() == provider.External {
+		return false
+	}
+	return r.Cluster() != nodeClusterID
+}
+
+// GetProxyServiceInstances lists service instances co-located with a given
+// proxy, restricted to the registries relevant to that proxy's cluster and
+// partition (see PartitionLabel).
+func (c *Controller) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	var nodeClusterID cluster.ID
+	if node.Metadata != nil {
+		nodeClusterID = node.Metadata.ClusterID
+	}
+	nodePartition := proxyPartition(node)
+	out := make([]*model.ServiceInstance, 0)
+	for _, r := range c.registries {
+		if skipSearchingRegistryForProxyAndPartition(nodeClusterID, nodePartition, r.Instance) {
+			scope.Debugf("GetProxyServiceInstances(): not searching registry %v: proxy %s in cluster %s partition %s",
+				r.Cluster(), node.ID, nodeClusterID, nodePartition)
+			continue
+		}
+		instances := r.GetProxyServiceInstances(node)
+		out = append(out, instances...)
+	}
+
+	return out
+}
+
+// GetProxyWorkloadLabels returns the labels of the workload(s) backing the given
+// proxy, taken from whichever registry first reports them. If no registries
+// return workload labels, nil is returned (rather than an empty list) so that
+// callers can distinguish "no labels" from "labels not found".
+func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) labels.Collection {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	for _, r := range c.registries {
+		if l := r.GetProxyWorkloadLabels(proxy); len(l) > 0 {
+			return l
+		}
+	}
+	return nil
+}
+
+// InstancesByPort retrieves instances for a service on the given port that
+// match the given labels. Only the registries the index knows serve the
+// service's hostname are queried, falling back to a full scan if the index
+// has no record of it yet.
+func (c *Controller) InstancesByPort(svc *model.Service, port int, lbls labels.Collection) []*model.ServiceInstance {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	regs, ok := c.index.registriesForHost(svc.Hostname)
+	if !ok {
+		regs = entriesSlice(c.registries)
+	}
+
+	out := make([]*model.ServiceInstance, 0)
+	for _, r := range regs {
+		instances := r.InstancesByPort(svc, port, lbls)
+		out = append(out, instances...)
+	}
+	return out
+}
+
+// InstancesByPortForProxy behaves like InstancesByPort, but additionally
+// scopes the search to registries visible to node's cluster and partition
+// (see PartitionLabel).
+func (c *Controller) InstancesByPortForProxy(svc *model.Service, port int, lbls labels.Collection, node *model.Proxy) []*model.ServiceInstance {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	regs, ok := c.index.registriesForHost(svc.Hostname)
+	if !ok {
+		regs = entriesSlice(c.registries)
+	}
+	nodePartition := proxyPartition(node)
+
+	out := make([]*model.ServiceInstance, 0)
+	for _, r := range regs {
+		if skipSearchingRegistryForProxyAndPartition(node.Metadata.ClusterID, nodePartition, r.Instance) {
+			continue
+		}
+		out = append(out, r.InstancesByPort(svc, port, lbls)...)
+	}
+	return out
+}
+
+// ProxyScopedDiscovery is a view of a Controller scoped to a single proxy's
+// cluster and partition, returned by Controller.ForProxy. Callers with proxy
+// context (e.g. xDS generation) should look up services and instances
+// through this rather than calling Controller.GetService/InstancesByPort
+// directly, to avoid leaking services across tenants/clusters.
+type ProxyScopedDiscovery struct {
+	c    *Controller
+	node *model.Proxy
+}
+
+// ForProxy returns a ProxyScopedDiscovery view of c scoped to node's cluster
+// and partition (see PartitionLabel).
+func (c *Controller) ForProxy(node *model.Proxy) ProxyScopedDiscovery {
+	return ProxyScopedDiscovery{c: c, node: node}
+}
+
+// GetService retrieves a service by hostname, restricted to registries
+// visible to the scoped proxy. See Controller.GetServiceForProxy.
+func (p ProxyScopedDiscovery) GetService(hostname host.Name) *model.Service {
+	return p.c.GetServiceForProxy(hostname, p.node)
+}
+
+// InstancesByPort retrieves instances for a service on the given port that
+// match the given labels, restricted to registries visible to the scoped
+// proxy. See Controller.InstancesByPortForProxy.
+func (p ProxyScopedDiscovery) InstancesByPort(svc *model.Service, port int, lbls labels.Collection) []*model.ServiceInstance {
+	return p.c.InstancesByPortForProxy(svc, port, lbls, p.node)
+}
+
+// GetProxyServiceInstances lists service instances co-located with the
+// scoped proxy. See Controller.GetProxyServiceInstances.
+func (p ProxyScopedDiscovery) GetProxyServiceInstances() []*model.ServiceInstance {
+	return p.c.GetProxyServiceInstances(p.node)
+}
+
+// entriesSlice returns a shallow copy of registries ordered by descending
+// weight (see WeightedInstance), used both as the registry snapshot handed to
+// serviceIndex.rebuild and as a fallback scan target when the index has no
+// record of a hostname - so a fallback scan merges higher-weight registries
+// first, the same as an indexed lookup would.
+func entriesSlice(registries []*registryEntry) []*registryEntry {
+	out := make([]*registryEntry, len(registries))
+	copy(out, registries)
+	sortByWeightDesc(out)
+	return out
+}
+
+// GetIstioServiceAccounts aggregates the service accounts of a service from all
+// registries, expanding them by the mesh's configured trust domain aliases.
+func (c *Controller) GetIstioServiceAccounts(svc *model.Service, ports []int) []string {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+
+	seen := make(map[string]struct{})
+	accounts := make([]string, 0)
+	for _, r := range c.registries {
+		for _, sa := range r.GetIstioServiceAccounts(svc, ports) {
+			if _, ok := seen[sa]; !ok {
+				seen[sa] = struct{}{}
+				accounts = append(accounts, sa)
+			}
+		}
+	}
+
+	var aliases []string
+	if c.meshHolder != nil {
+		aliases = c.meshHolder.Mesh().GetTrustDomainAliases()
+	}
+	if len(aliases) > 0 {
+		expanded := make([]string, 0, len(accounts)*len(aliases))
+		expandedSeen := make(map[string]struct{})
+		for _, sa := range accounts {
+			idx := strings.Index(sa, "/ns/")
+			if idx < 0 {
+				if _, ok := expandedSeen[sa]; !ok {
+					expandedSeen[sa] = struct{}{}
+					expanded = append(expanded, sa)
+				}
+				continue
+			}
+			suffix := sa[idx:]
+			for _, alias := range aliases {
+				aliased := "spiffe://" + alias + suffix
+				if _, ok := expandedSeen[aliased]; !ok {
+					expandedSeen[aliased] = struct{}{}
+					expanded = append(expanded, aliased)
+				}
+			}
+		}
+		accounts = expanded
+	}
+
+	sort.Strings(accounts)
+	return accounts
+}
+
+// Run starts all the registries added so far and blocks until stop is closed.
+// Registries added after Run has been called are not started automatically;
+// use AddRegistryAndRun for those.
+func (c *Controller) Run(stop <-chan struct{}) {
+	c.registryListMutex.Lock()
+	c.running = true
+	registries := make([]*registryEntry, len(c.registries))
+	copy(registries, c.registries)
+	c.registryListMutex.Unlock()
+
+	for _, r := range registries {
+		go r.Run(stop)
+	}
+
+	<-stop
+	scope.Info("Registry Aggregator terminated")
+}
+
+// HasSynced returns true if all the registries have synced.
+func (c *Controller) HasSynced() bool {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+	for _, r := range c.registries {
+		if !r.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// AppendServiceHandler registers f to be called on service change events from
+// every attached registry.
+func (c *Controller) AppendServiceHandler(f func(*model.Service, model.Event)) {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+	for _, r := range c.registries {
+		r.AppendServiceHandler(f)
+	}
+}
+
+// AppendWorkloadHandler registers f to be called on workload change events from
+// every attached registry.
+func (c *Controller) AppendWorkloadHandler(f func(*model.WorkloadInstance, model.Event)) {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+	for _, r := range c.registries {
+		r.AppendWorkloadHandler(f)
+	}
+}
+
+// NetworkGateways merges the network gateways from all attached registries.
+func (c *Controller) NetworkGateways() []*model.NetworkGateway {
+	c.registryListMutex.RLock()
+	defer c.registryListMutex.RUnlock()
+	var out []*model.NetworkGateway
+	for _, r := range c.registries {
+		out = append(out, r.NetworkGateways()...)
+	}
+	return out
+}
@@ -78,7 +78,7 @@ func buildMockController() *Controller {
 		Controller:       &mock.Controller{},
 	}
 
-	ctls := NewController(Options{&meshHolder})
+	ctls := NewController(Options{MeshHolder: &meshHolder})
 	ctls.AddRegistry(registry1)
 	ctls.AddRegistry(registry2)
 
@@ -502,6 +502,140 @@ func TestSkipSearchingRegistryForProxy(t *testing.T) {
 	}
 }
 
+type partitionedRegistry struct {
+	serviceregistry.Simple
+	partition Partition
+}
+
+func (r partitionedRegistry) Partition() Partition {
+	return r.partition
+}
+
+func TestSkipSearchingRegistryForProxyAndPartition(t *testing.T) {
+	tenantA := partitionedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:  "cluster-1",
+			ProviderID: provider.Kubernetes,
+			Controller: &mock.Controller{},
+		},
+		partition: "tenant-a",
+	}
+	tenantB := partitionedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:  "cluster-1",
+			ProviderID: provider.Kubernetes,
+			Controller: &mock.Controller{},
+		},
+		partition: "tenant-b",
+	}
+	unpartitioned := serviceregistry.Simple{
+		ClusterID:  "cluster-1",
+		ProviderID: provider.Kubernetes,
+		Controller: &mock.Controller{},
+	}
+	external := partitionedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:  "cluster-1",
+			ProviderID: provider.External,
+			Controller: &mock.Controller{},
+		},
+		partition: "tenant-b",
+	}
+
+	cases := []struct {
+		name          string
+		nodeClusterID cluster.ID
+		nodePartition Partition
+		registry      serviceregistry.Instance
+		want          bool
+	}{
+		{"matching partition", "cluster-1", "tenant-a", tenantA, false},
+		{"mismatching partition", "cluster-1", "tenant-a", tenantB, true},
+		{"empty node partition searches all", "cluster-1", "", tenantB, false},
+		{"unpartitioned registry always searched", "cluster-1", "tenant-a", unpartitioned, false},
+		{"external always searched regardless of partition", "cluster-1", "tenant-a", external, false},
+		{"cluster mismatch skips even with matching partition", "cluster-2", "tenant-a", tenantA, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := skipSearchingRegistryForProxyAndPartition(c.nodeClusterID, c.nodePartition, c.registry)
+			if got != c.want {
+				t.Errorf("got %v want %v", got, c.want)
+			}
+		})
+	}
+}
+
+// TestForProxyScoping exercises Controller.ForProxy end-to-end: a proxy
+// scoped to tenant-a must not see a same-hostname service hosted only in
+// tenant-b's registry, through either ForProxy method.
+func TestForProxyScoping(t *testing.T) {
+	tenantADiscovery := mock.NewDiscovery(
+		map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.ServiceArgs{
+				Hostname:        "hello.default.svc.cluster.local",
+				Address:         "10.1.1.1",
+				ServiceAccounts: []string{},
+				ClusterID:       "cluster-1",
+			}),
+		}, 2)
+	tenantBDiscovery := mock.NewDiscovery(
+		map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.ServiceArgs{
+				Hostname:        "hello.default.svc.cluster.local",
+				Address:         "10.2.2.2",
+				ServiceAccounts: []string{},
+				ClusterID:       "cluster-1",
+			}),
+		}, 2)
+
+	tenantA := partitionedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:        "cluster-1",
+			ProviderID:       provider.Kubernetes,
+			ServiceDiscovery: tenantADiscovery,
+			Controller:       &mock.Controller{},
+		},
+		partition: "tenant-a",
+	}
+	tenantB := partitionedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:        "cluster-1",
+			ProviderID:       provider.Kubernetes,
+			ServiceDiscovery: tenantBDiscovery,
+			Controller:       &mock.Controller{},
+		},
+		partition: "tenant-b",
+	}
+
+	ctrl := NewController(Options{})
+	ctrl.AddRegistry(tenantA)
+	ctrl.AddRegistry(tenantB)
+
+	proxyA := &model.Proxy{
+		Metadata: &model.NodeMetadata{
+			ClusterID: "cluster-1",
+			Labels:    map[string]string{PartitionLabel: "tenant-a"},
+		},
+	}
+
+	svc := ctrl.ForProxy(proxyA).GetService(mock.HelloService.Hostname)
+	if svc == nil {
+		t.Fatal("Fail to get service")
+	}
+	if svc.Address != "10.1.1.1" {
+		t.Fatalf("expected tenant-a's service (address 10.1.1.1), got %s - tenant-b's service leaked across partitions", svc.Address)
+	}
+
+	// mock.NewDiscovery backs each service with 2 instances; if tenant-b's
+	// registry leaked in despite the partition mismatch, this would return 4.
+	instances := ctrl.ForProxy(proxyA).InstancesByPort(svc, 80, labels.Collection{})
+	if len(instances) != 2 {
+		t.Fatalf("expected 2 instances from tenant-a only, got %d - tenant-b's instances leaked across partitions", len(instances))
+	}
+}
+
 func runnableRegistry(name string) *RunnableRegistry {
 	return &RunnableRegistry{
 		Instance: serviceregistry.Simple{
@@ -561,3 +695,279 @@ func TestDeferredRun(t *testing.T) {
 		expectRunningOrFail(t, ctrl, true)
 	})
 }
+
+func drainEvent(t *testing.T, ch <-chan RegistryEvent) RegistryEvent {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for RegistryEvent")
+		return RegistryEvent{}
+	}
+}
+
+func TestSubscribeDeferredRunLifecycle(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	ctrl := NewController(Options{})
+
+	events, cancel := ctrl.Subscribe()
+	defer cancel()
+
+	ctrl.AddRegistry(runnableRegistry("sub-early"))
+	if ev := drainEvent(t, events); ev.Type != RegistryAdded || ev.ClusterID != "sub-early" {
+		t.Fatalf("expected RegistryAdded for sub-early, got %+v", ev)
+	}
+
+	ctrl.AddRegistryAndRun(runnableRegistry("sub-early-run"), nil)
+	if ev := drainEvent(t, events); ev.Type != RegistryAdded || ev.ClusterID != "sub-early-run" {
+		t.Fatalf("expected RegistryAdded for sub-early-run, got %+v", ev)
+	}
+
+	go ctrl.Run(stop)
+	expectRunningOrFail(t, ctrl, true)
+
+	ctrl.DeleteRegistry("sub-early", "test")
+	if ev := drainEvent(t, events); ev.Type != RegistryDeleted || ev.ClusterID != "sub-early" {
+		t.Fatalf("expected terminal RegistryDeleted for sub-early, got %+v", ev)
+	}
+
+	ctrl.DeleteRegistry("sub-early-run", "test")
+	if ev := drainEvent(t, events); ev.Type != RegistryDeleted || ev.ClusterID != "sub-early-run" {
+		t.Fatalf("expected terminal RegistryDeleted for sub-early-run, got %+v", ev)
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	ctrl := NewController(Options{})
+	events, cancel := ctrl.Subscribe()
+
+	ctrl.AddRegistry(runnableRegistry("before-cancel"))
+	drainEvent(t, events)
+
+	cancel()
+
+	ctrl.AddRegistry(runnableRegistry("after-cancel"))
+	if _, ok := <-events; ok {
+		t.Fatal("expected channel to be closed after cancel")
+	}
+}
+
+// TestDeleteRegistryFlushesPendingServiceChanged races DeleteRegistry against
+// a pending event's debounce timer: the debounce window is short enough, and
+// the sleep before DeleteRegistry long enough, that the timer has usually
+// already fired - and its AfterFunc callback is running or about to run -
+// by the time DeleteRegistry calls dropPending, exercising the race the
+// "cancelled" flag (not Timer.Stop()'s return value) is what actually closes.
+// A firing that got pendingMu before dropPending publishes its service-changed
+// event ahead of the terminal RegistryDeleted; the test accepts that one event
+// and then checks that RegistryDeleted arrives and nothing follows it.
+// Run across many iterations since the exact interleaving isn't deterministic.
+func TestDeleteRegistryFlushesPendingServiceChanged(t *testing.T) {
+	const debounce = time.Millisecond
+	const iterations = 200
+
+	for i := 0; i < iterations; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("flush-me-%d", i))
+		ctrl := NewController(Options{EventDebounce: debounce})
+		events, cancel := ctrl.Subscribe()
+
+		ctrl.AddRegistry(runnableRegistry(string(clusterID)))
+		if ev := drainEvent(t, events); ev.Type != RegistryAdded || ev.ClusterID != clusterID {
+			t.Fatalf("iteration %d: expected RegistryAdded for %s, got %+v", i, clusterID, ev)
+		}
+
+		ctrl.events.publishServiceChanged(RegistryEvent{
+			Type:      RegistryServiceChanged,
+			ClusterID: clusterID,
+		})
+
+		time.Sleep(debounce)
+		ctrl.DeleteRegistry(clusterID, "test")
+
+		ev := drainEvent(t, events)
+		if ev.Type == RegistryServiceChanged && ev.ClusterID == clusterID {
+			// Published by a firing that completed before dropPending ran.
+			ev = drainEvent(t, events)
+		}
+		if ev.Type != RegistryDeleted || ev.ClusterID != clusterID {
+			t.Fatalf("iteration %d: expected terminal RegistryDeleted for %s, got %+v", i, clusterID, ev)
+		}
+
+		select {
+		case stray := <-events:
+			t.Fatalf("iteration %d: expected no further events after the terminal RegistryDeleted, got %+v", i, stray)
+		case <-time.After(2 * time.Millisecond):
+		}
+		cancel()
+	}
+}
+
+type weightedRegistry struct {
+	serviceregistry.Simple
+	weight int
+}
+
+func (r weightedRegistry) Weight() int {
+	return r.weight
+}
+
+func TestSortByWeightDesc(t *testing.T) {
+	reg := func(name string, weight int) *registryEntry {
+		return &registryEntry{Instance: weightedRegistry{
+			Simple: serviceregistry.Simple{
+				ClusterID:  cluster.ID(name),
+				ProviderID: provider.Kubernetes,
+				Controller: &mock.Controller{},
+			},
+			weight: weight,
+		}}
+	}
+	unweighted := &registryEntry{Instance: serviceregistry.Simple{
+		ClusterID:  "unweighted",
+		ProviderID: provider.Kubernetes,
+		Controller: &mock.Controller{},
+	}}
+
+	regs := []*registryEntry{reg("low", 1), unweighted, reg("high", 10), reg("mid", 5)}
+	sortByWeightDesc(regs)
+
+	var order []cluster.ID
+	for _, r := range regs {
+		order = append(order, r.Cluster())
+	}
+	want := []cluster.ID{"high", "mid", "low", "unweighted"}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("sortByWeightDesc order = %v, want %v", order, want)
+	}
+}
+
+// TestGetServiceWeightOrdering asserts that GetService consults the
+// higher-weight registry first when the same hostname is reported by more
+// than one registry, regardless of registration order.
+func TestGetServiceWeightOrdering(t *testing.T) {
+	lowDiscovery := mock.NewDiscovery(
+		map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.ServiceArgs{
+				Hostname:        "hello.default.svc.cluster.local",
+				Address:         "10.9.9.9",
+				ServiceAccounts: []string{},
+				ClusterID:       "low",
+			}),
+		}, 2)
+	highDiscovery := mock.NewDiscovery(
+		map[host.Name]*model.Service{
+			mock.HelloService.Hostname: mock.MakeService(mock.ServiceArgs{
+				Hostname:        "hello.default.svc.cluster.local",
+				Address:         "10.1.1.1",
+				ServiceAccounts: []string{},
+				ClusterID:       "high",
+			}),
+		}, 2)
+
+	low := weightedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:        "low",
+			ProviderID:       provider.Kubernetes,
+			ServiceDiscovery: lowDiscovery,
+			Controller:       &mock.Controller{},
+		},
+		weight: 1,
+	}
+	high := weightedRegistry{
+		Simple: serviceregistry.Simple{
+			ClusterID:        "high",
+			ProviderID:       provider.Kubernetes,
+			ServiceDiscovery: highDiscovery,
+			Controller:       &mock.Controller{},
+		},
+		weight: 10,
+	}
+
+	ctrl := NewController(Options{})
+	// Register the lower-weight registry first, so a passing test proves
+	// weight - not registration order - determines merge precedence.
+	ctrl.AddRegistry(low)
+	ctrl.AddRegistry(high)
+
+	svc := ctrl.GetService(mock.HelloService.Hostname)
+	if svc == nil {
+		t.Fatal("Fail to get service")
+	}
+	if svc.Address != "10.1.1.1" {
+		t.Fatalf("expected the higher-weight registry (address 10.1.1.1) to win merge precedence, got %s", svc.Address)
+	}
+}
+
+// buildMockControllerForManyRegistries builds an aggregate Controller backed
+// by n single-cluster registries that all serve the same replicated hostname,
+// used to exercise the hostname/cluster index at a scale where a full scan of
+// every registry on every call would be noticeable.
+func buildMockControllerForManyRegistries(n int) *Controller {
+	ctls := NewController(Options{})
+	for i := 0; i < n; i++ {
+		clusterID := cluster.ID(fmt.Sprintf("cluster-%d", i))
+		discovery := mock.NewDiscovery(
+			map[host.Name]*model.Service{
+				mock.HelloService.Hostname: mock.MakeService(mock.ServiceArgs{
+					Hostname:        "hello.default.svc.cluster.local",
+					Address:         fmt.Sprintf("10.%d.%d.0", i/256, i%256),
+					ServiceAccounts: []string{},
+					ClusterID:       clusterID,
+				}),
+			}, 2)
+		registry := serviceregistry.Simple{
+			ProviderID:       provider.Kubernetes,
+			ClusterID:        clusterID,
+			ServiceDiscovery: discovery,
+			Controller:       &mock.Controller{},
+		}
+		ctls.AddRegistry(registry)
+	}
+	return ctls
+}
+
+func TestServicesForManyRegistries(t *testing.T) {
+	const n = 256
+	aggregateCtl := buildMockControllerForManyRegistries(n)
+
+	services, err := aggregateCtl.Services()
+	if err != nil {
+		t.Fatalf("Services() encountered unexpected error: %v", err)
+	}
+	for _, svc := range services {
+		if svc.Hostname != mock.HelloService.Hostname {
+			continue
+		}
+		if len(svc.ClusterVIPs.Addresses) != n {
+			t.Fatalf("expected %d cluster VIPs for %s, got %d", n, svc.Hostname, len(svc.ClusterVIPs.Addresses))
+		}
+	}
+
+	// GetService and InstancesByPort should use the hostname index rather
+	// than scanning all n registries; BenchmarkGetServiceManyRegistries
+	// demonstrates the resulting improvement.
+	svc := aggregateCtl.GetService(mock.HelloService.Hostname)
+	if svc == nil || len(svc.ClusterVIPs.Addresses) != n {
+		t.Fatalf("GetService returned unexpected merged result: %+v", svc)
+	}
+}
+
+func BenchmarkGetServiceManyRegistries(b *testing.B) {
+	aggregateCtl := buildMockControllerForManyRegistries(256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		aggregateCtl.GetService(mock.HelloService.Hostname)
+	}
+}
+
+func BenchmarkServicesManyRegistries(b *testing.B) {
+	aggregateCtl := buildMockControllerForManyRegistries(256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := aggregateCtl.Services(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
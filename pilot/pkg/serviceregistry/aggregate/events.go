@@ -0,0 +1,192 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// RegistryEventType enumerates the kinds of events an aggregate Controller
+// subscriber can observe via Subscribe.
+type RegistryEventType int
+
+const (
+	// RegistryAdded fires when a registry is added via AddRegistry or AddRegistryAndRun.
+	RegistryAdded RegistryEventType = iota
+	// RegistryDeleted fires when a registry is removed via DeleteRegistry. It is a
+	// terminal event for that cluster/provider: subscribers should use it to clean
+	// up any cluster-scoped state they have been tracking.
+	RegistryDeleted
+	// RegistryServiceChanged fires when a member registry reports a service add,
+	// update, or delete.
+	RegistryServiceChanged
+)
+
+// RegistryEvent describes a registry membership or service change observed by
+// the aggregate Controller.
+type RegistryEvent struct {
+	Type       RegistryEventType
+	ClusterID  cluster.ID
+	ProviderID provider.ID
+	// Service is set only for RegistryServiceChanged events.
+	Service *model.Service
+}
+
+// CancelFunc unsubscribes a channel returned by Controller.Subscribe; no
+// further events are sent to it afterwards, and the channel is closed.
+type CancelFunc func()
+
+// subscriberBufferSize bounds how many events a subscriber can lag behind
+// before further events are dropped (and counted) rather than blocking the
+// publisher - typically AddRegistry, DeleteRegistry, or a member registry's
+// own service-change handler.
+const subscriberBufferSize = 256
+
+type subscriber struct {
+	ch      chan RegistryEvent
+	dropped uint64
+}
+
+// eventBus fans RegistryEvents out to subscribers registered through
+// Controller.Subscribe. Service-change events are coalesced per cluster
+// within a debounce window; membership events (add/delete) are always
+// delivered immediately so that ordering and terminal semantics are
+// preserved.
+type eventBus struct {
+	debounce time.Duration
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+
+	pendingMu sync.Mutex
+	pending   map[cluster.ID]*pendingEvent
+}
+
+type pendingEvent struct {
+	timer *time.Timer
+	event RegistryEvent
+	// cancelled is set by dropPending, under pendingMu, to tell the AfterFunc
+	// callback below not to publish even if it has already fired by the time
+	// dropPending runs. Timer.Stop() alone can't make that guarantee: once a
+	// timer has fired, Stop returns false and the scheduled function still
+	// runs to completion regardless.
+	cancelled bool
+}
+
+func newEventBus(debounce time.Duration) *eventBus {
+	return &eventBus{
+		debounce:    debounce,
+		subscribers: make(map[*subscriber]struct{}),
+		pending:     make(map[cluster.ID]*pendingEvent),
+	}
+}
+
+// subscribe registers a new subscriber and returns its event channel and a
+// CancelFunc that unregisters it and closes the channel.
+func (b *eventBus) subscribe() (<-chan RegistryEvent, CancelFunc) {
+	sub := &subscriber{ch: make(chan RegistryEvent, subscriberBufferSize)}
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub.ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[sub]; ok {
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// publish delivers event to every subscriber immediately. Subscribers that
+// are not keeping up have the event dropped rather than blocking the caller.
+func (b *eventBus) publish(event RegistryEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped++
+			scope.Warnf("aggregate: dropped event type=%v for cluster %s (subscriber backlog full, %d dropped total)",
+				event.Type, event.ClusterID, sub.dropped)
+		}
+	}
+}
+
+// dropPending cancels and discards any coalesced RegistryServiceChanged event
+// still waiting out its debounce window for clusterID, without publishing it.
+// Callers that are about to publish a terminal event for clusterID (i.e.
+// DeleteRegistry) must call this first, otherwise the pending event's timer
+// would still fire on its own and deliver a stale service-changed event after
+// the terminal one.
+//
+// Setting cancelled and removing the map entry both happen under pendingMu,
+// the same lock the AfterFunc callback in publishServiceChanged holds for its
+// own check-and-publish - so if the timer has already fired and is blocked on
+// pendingMu when dropPending runs, dropPending itself blocks until that
+// firing's publish (or no-op) has completed, and any firing that starts after
+// dropPending returns is guaranteed to see cancelled and skip publishing.
+// Either way, this always returns before any further event for clusterID can
+// be published, so the terminal event DeleteRegistry publishes immediately
+// afterwards is guaranteed to be the last one.
+func (b *eventBus) dropPending(clusterID cluster.ID) {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	if p, ok := b.pending[clusterID]; ok {
+		p.cancelled = true
+		p.timer.Stop()
+		delete(b.pending, clusterID)
+	}
+}
+
+// publishServiceChanged coalesces bursts of RegistryServiceChanged events for
+// the same cluster within the debounce window, publishing only the most
+// recent one once the window elapses. The window starts at the first event of
+// a burst and is not extended by later events for that cluster. A zero
+// debounce window disables coalescing.
+func (b *eventBus) publishServiceChanged(event RegistryEvent) {
+	if b.debounce <= 0 {
+		b.publish(event)
+		return
+	}
+
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	if p, ok := b.pending[event.ClusterID]; ok {
+		p.event = event
+		return
+	}
+	p := &pendingEvent{event: event}
+	p.timer = time.AfterFunc(b.debounce, func() {
+		// Held for the whole check-and-publish, not just the map bookkeeping,
+		// so dropPending can't return while a firing it raced with is still
+		// in the middle of publishing - see dropPending's doc comment.
+		b.pendingMu.Lock()
+		defer b.pendingMu.Unlock()
+		if p.cancelled {
+			return
+		}
+		delete(b.pending, event.ClusterID)
+		b.publish(p.event)
+	})
+	b.pending[event.ClusterID] = p
+}
@@ -0,0 +1,395 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// defaultExtenderTimeout bounds HTTP calls to an extender when no per-config
+// timeout is configured.
+const defaultExtenderTimeout = 5 * time.Second
+
+// defaultCircuitBreakThreshold is how many consecutive failures from an
+// extender trip the circuit, causing it to be skipped until it cools down.
+const defaultCircuitBreakThreshold = 3
+
+// defaultCircuitBreakCooldown is how long an unhealthy extender is skipped
+// before it is tried again.
+const defaultCircuitBreakCooldown = 30 * time.Second
+
+// errExtenderNotFound is returned by doJSON when the extender responds with
+// HTTP 404. A 404 means "no such service/instance for this lookup" - a normal
+// outcome, since e.g. GetService is called for any hostname matching the
+// configured HostnameSuffix whether or not this extender actually carries it
+// - and must not be treated as an extender-health failure the way a 5xx,
+// timeout, or network error is.
+var errExtenderNotFound = errors.New("extender: not found")
+
+// extenderKind identifies which extender endpoint a circuit breaker tracks.
+// Breaker state is kept per kind, not shared across the extender as a whole,
+// so that e.g. routine 404s from GetService don't trip the breaker for
+// Services or GetProxyServiceInstances.
+type extenderKind int
+
+const (
+	kindServices extenderKind = iota
+	kindService
+	kindInstancesByProxy
+	kindInstancesByPort
+	kindServiceAccounts
+)
+
+// circuitState is the consecutive-failure counter and cooldown deadline for
+// one extenderKind.
+type circuitState struct {
+	mu                sync.Mutex
+	consecutiveErrors int
+	openUntil         time.Time
+}
+
+// ExtenderConfig describes a single out-of-process service registry
+// implementing the HTTP(S) extender protocol, modeled on Kubernetes' scheduler
+// extender pattern. Operators use this to plug custom service catalogs
+// (proprietary IPAMs, legacy CMDBs, etc.) into the mesh without recompiling
+// Pilot.
+type ExtenderConfig struct {
+	// ClusterID uniquely identifies this extender among the aggregate's registries.
+	ClusterID cluster.ID
+	// URL is the base address of the extender; requests are issued as
+	// "<URL>/services", "<URL>/service", "<URL>/instancesByPort", etc.
+	URL string
+	// Timeout bounds each HTTP call to the extender. Defaults to defaultExtenderTimeout.
+	Timeout time.Duration
+	// TLSConfig is used for HTTPS extenders. Nil means plain HTTP.
+	TLSConfig *tls.Config
+	// Weight influences merge ordering when the same hostname is reported by
+	// multiple registries; higher weight extenders are consulted first.
+	Weight int
+	// HostnameSuffix restricts this extender to hostnames with the given
+	// suffix (e.g. ".legacy.internal"). Empty means no filtering.
+	HostnameSuffix string
+	// CacheTTL controls how long responses are cached so hot paths like
+	// GetProxyServiceInstances do not perform a synchronous HTTP call on
+	// every push. Zero disables caching.
+	CacheTTL time.Duration
+}
+
+// httpExtenderCacheEntry holds a cached response along with its expiry.
+type httpExtenderCacheEntry struct {
+	instances []*model.ServiceInstance
+	expiresAt time.Time
+}
+
+// HTTPExtenderRegistry implements serviceregistry.Instance by delegating to a
+// remote HTTP(S) endpoint returning JSON, the same way a Kubernetes scheduler
+// extender delegates filter/prioritize decisions to an out-of-process webhook.
+//
+// Calls that sit on the proxy push hot path (GetProxyServiceInstances) are
+// cached, keyed on proxy IP, and guarded by a simple circuit breaker,
+// tracked independently per endpoint kind, so an unhealthy extender is
+// skipped rather than stalling every push.
+type HTTPExtenderRegistry struct {
+	config ExtenderConfig
+	client *http.Client
+
+	cacheMu sync.RWMutex
+	cache   map[string]httpExtenderCacheEntry
+
+	breakers map[extenderKind]*circuitState
+}
+
+// NewHTTPExtenderRegistry creates a registry that proxies service discovery
+// calls to a remote HTTP(S) extender described by config.
+func NewHTTPExtenderRegistry(config ExtenderConfig) *HTTPExtenderRegistry {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultExtenderTimeout
+	}
+	transport := &http.Transport{}
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig
+	}
+	return &HTTPExtenderRegistry{
+		config: config,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+		cache: make(map[string]httpExtenderCacheEntry),
+		breakers: map[extenderKind]*circuitState{
+			kindServices:         {},
+			kindService:          {},
+			kindInstancesByProxy: {},
+			kindInstancesByPort:  {},
+			kindServiceAccounts:  {},
+		},
+	}
+}
+
+// Weight implements WeightedInstance, letting this extender's configured
+// Weight influence merge ordering when the same hostname is reported by more
+// than one registry.
+func (e *HTTPExtenderRegistry) Weight() int {
+	return e.config.Weight
+}
+
+// Provider implements serviceregistry.Instance.
+func (e *HTTPExtenderRegistry) Provider() provider.ID {
+	return provider.External
+}
+
+// Cluster implements serviceregistry.Instance.
+func (e *HTTPExtenderRegistry) Cluster() cluster.ID {
+	return e.config.ClusterID
+}
+
+// Run implements model.Controller. The extender is a passive HTTP backend,
+// so Run only waits for shutdown.
+func (e *HTTPExtenderRegistry) Run(stop <-chan struct{}) {
+	<-stop
+}
+
+// HasSynced implements model.Controller. An HTTP extender has no local cache
+// to warm, so it is always considered synced.
+func (e *HTTPExtenderRegistry) HasSynced() bool {
+	return true
+}
+
+// AppendServiceHandler implements model.Controller. HTTP extenders are polled
+// on demand rather than pushing change notifications, so this is a no-op.
+func (e *HTTPExtenderRegistry) AppendServiceHandler(func(*model.Service, model.Event)) {}
+
+// AppendWorkloadHandler implements model.Controller; see AppendServiceHandler.
+func (e *HTTPExtenderRegistry) AppendWorkloadHandler(func(*model.WorkloadInstance, model.Event)) {}
+
+// NetworkGateways implements model.ServiceDiscovery. Extenders do not describe
+// network gateways.
+func (e *HTTPExtenderRegistry) NetworkGateways() []*model.NetworkGateway {
+	return nil
+}
+
+// GetProxyWorkloadLabels implements model.ServiceDiscovery. Extenders describe
+// services, not individual workloads, so no labels are returned.
+func (e *HTTPExtenderRegistry) GetProxyWorkloadLabels(*model.Proxy) labels.Collection {
+	return nil
+}
+
+// matchesHostname reports whether the configured hostname suffix filter, if
+// any, allows hostname to be served by this extender.
+func (e *HTTPExtenderRegistry) matchesHostname(hostname host.Name) bool {
+	if e.config.HostnameSuffix == "" {
+		return true
+	}
+	return strings.HasSuffix(string(hostname), e.config.HostnameSuffix)
+}
+
+// isCircuitOpen reports whether kind has been marked unhealthy and is still
+// within its cooldown window, mirroring skipSearchingRegistryForProxy's
+// approach of skipping registries that cannot usefully answer a query.
+func (e *HTTPExtenderRegistry) isCircuitOpen(kind extenderKind) bool {
+	b := e.breakers[kind]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && time.Now().Before(b.openUntil)
+}
+
+// recordResult updates kind's circuit breaker state after an HTTP call. A nil
+// err resets the breaker; callers must not call this for errExtenderNotFound,
+// since a 404 is a normal response, not an extender-health failure.
+func (e *HTTPExtenderRegistry) recordResult(kind extenderKind, err error) {
+	b := e.breakers[kind]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.consecutiveErrors = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.consecutiveErrors++
+	if b.consecutiveErrors >= defaultCircuitBreakThreshold {
+		b.openUntil = time.Now().Add(defaultCircuitBreakCooldown)
+	}
+}
+
+// doJSON issues a GET request against "<URL><path>" and decodes the JSON
+// response into out, tracking kind's circuit breaker. A 404 response returns
+// errExtenderNotFound without touching the breaker: it means this lookup
+// found nothing, not that the extender is unhealthy.
+func (e *HTTPExtenderRegistry) doJSON(kind extenderKind, path string, out interface{}) error {
+	if e.isCircuitOpen(kind) {
+		return fmt.Errorf("extender %s circuit open, skipping request", e.config.ClusterID)
+	}
+	req, err := http.NewRequest(http.MethodGet, e.config.URL+path, nil)
+	if err != nil {
+		e.recordResult(kind, err)
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.recordResult(kind, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errExtenderNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("extender %s returned status %d", e.config.ClusterID, resp.StatusCode)
+		e.recordResult(kind, err)
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	e.recordResult(kind, err)
+	return err
+}
+
+// Services implements model.ServiceDiscovery by delegating to the extender's
+// "/services" endpoint.
+func (e *HTTPExtenderRegistry) Services() ([]*model.Service, error) {
+	var services []*model.Service
+	if err := e.doJSON(kindServices, "/services", &services); err != nil {
+		if errors.Is(err, errExtenderNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out := services[:0]
+	for _, s := range services {
+		if e.matchesHostname(s.Hostname) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// GetService implements model.ServiceDiscovery by delegating to the
+// extender's "/service?hostname=" endpoint.
+func (e *HTTPExtenderRegistry) GetService(hostname host.Name) *model.Service {
+	if !e.matchesHostname(hostname) {
+		return nil
+	}
+	var svc model.Service
+	if err := e.doJSON(kindService, "/service?hostname="+string(hostname), &svc); err != nil {
+		return nil
+	}
+	if svc.Hostname == "" {
+		// A 200 response decoded into the zero value - e.g. a JSON null body,
+		// the conventional way to say "no such service" for a singular resource
+		// lookup - is "not found", not a real match; returning &svc here would
+		// hand callers a phantom empty Service.
+		return nil
+	}
+	return &svc
+}
+
+// instanceCacheKey builds the cache key for an instance lookup from a
+// hostname and a second part: a proxy IP (with an empty hostname) for
+// GetProxyServiceInstances, or a port for InstancesByPort.
+func instanceCacheKey(hostname host.Name, proxyIP string) string {
+	return string(hostname) + "|" + proxyIP
+}
+
+// GetProxyServiceInstances implements model.ServiceDiscovery by delegating to
+// the extender's "/instancesByProxy" endpoint, caching the result per proxy
+// IP for CacheTTL so hot push paths avoid a synchronous call.
+func (e *HTTPExtenderRegistry) GetProxyServiceInstances(node *model.Proxy) []*model.ServiceInstance {
+	var out []*model.ServiceInstance
+	for _, ip := range node.IPAddresses {
+		key := instanceCacheKey("", ip)
+		if cached, ok := e.cacheLookup(key); ok {
+			out = append(out, cached...)
+			continue
+		}
+		var instances []*model.ServiceInstance
+		if err := e.doJSON(kindInstancesByProxy, "/instancesByProxy?ip="+ip, &instances); err != nil {
+			continue
+		}
+		e.cacheStore(key, instances)
+		out = append(out, instances...)
+	}
+	return out
+}
+
+// InstancesByPort implements model.ServiceDiscovery by delegating to the
+// extender's "/instancesByPort" endpoint, caching on hostname+port.
+func (e *HTTPExtenderRegistry) InstancesByPort(svc *model.Service, port int, _ labels.Collection) []*model.ServiceInstance {
+	if !e.matchesHostname(svc.Hostname) {
+		return nil
+	}
+	key := instanceCacheKey(svc.Hostname, fmt.Sprintf("%d", port))
+	if cached, ok := e.cacheLookup(key); ok {
+		return cached
+	}
+	var instances []*model.ServiceInstance
+	if err := e.doJSON(kindInstancesByPort, fmt.Sprintf("/instancesByPort?hostname=%s&port=%d", svc.Hostname, port), &instances); err != nil {
+		return nil
+	}
+	e.cacheStore(key, instances)
+	return instances
+}
+
+// GetIstioServiceAccounts implements model.ServiceDiscovery by delegating to
+// the extender's "/serviceAccounts" endpoint.
+func (e *HTTPExtenderRegistry) GetIstioServiceAccounts(svc *model.Service, _ []int) []string {
+	if !e.matchesHostname(svc.Hostname) {
+		return nil
+	}
+	var accounts []string
+	if err := e.doJSON(kindServiceAccounts, "/serviceAccounts?hostname="+string(svc.Hostname), &accounts); err != nil {
+		return nil
+	}
+	return accounts
+}
+
+// cacheLookup returns the cached instances for key if present and not expired.
+func (e *HTTPExtenderRegistry) cacheLookup(key string) ([]*model.ServiceInstance, bool) {
+	if e.config.CacheTTL <= 0 {
+		return nil, false
+	}
+	e.cacheMu.RLock()
+	defer e.cacheMu.RUnlock()
+	entry, ok := e.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.instances, true
+}
+
+// cacheStore saves instances for key, if caching is enabled.
+func (e *HTTPExtenderRegistry) cacheStore(key string, instances []*model.ServiceInstance) {
+	if e.config.CacheTTL <= 0 {
+		return
+	}
+	e.cacheMu.Lock()
+	defer e.cacheMu.Unlock()
+	e.cache[key] = httpExtenderCacheEntry{
+		instances: instances,
+		expiresAt: time.Now().Add(e.config.CacheTTL),
+	}
+}
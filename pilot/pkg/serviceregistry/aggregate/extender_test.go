@@ -0,0 +1,140 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestHTTPExtenderRegistryMatchesHostname(t *testing.T) {
+	cases := []struct {
+		name     string
+		suffix   string
+		hostname host.Name
+		want     bool
+	}{
+		{"no filter configured", "", "foo.default.svc.cluster.local", true},
+		{"suffix matches", ".legacy.internal", "foo.legacy.internal", true},
+		{"suffix does not match", ".legacy.internal", "foo.default.svc.cluster.local", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := NewHTTPExtenderRegistry(ExtenderConfig{ClusterID: "ext", HostnameSuffix: c.suffix})
+			if got := e.matchesHostname(c.hostname); got != c.want {
+				t.Errorf("matchesHostname(%q) = %v, want %v", c.hostname, got, c.want)
+			}
+		})
+	}
+}
+
+// instancesByPortServer serves a single *model.ServiceInstance for
+// "/instancesByPort" and counts how many times it was hit.
+func instancesByPortServer(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		instances := []*model.ServiceInstance{{Service: &model.Service{Hostname: "foo.default.svc.cluster.local"}}}
+		if err := json.NewEncoder(w).Encode(instances); err != nil {
+			t.Fatalf("failed to encode response: %v", err)
+		}
+	}))
+}
+
+func TestHTTPExtenderRegistryCacheHitAndExpiry(t *testing.T) {
+	var hits int32
+	srv := instancesByPortServer(t, &hits)
+	defer srv.Close()
+
+	e := NewHTTPExtenderRegistry(ExtenderConfig{
+		ClusterID: "ext",
+		URL:       srv.URL,
+		CacheTTL:  30 * time.Millisecond,
+	})
+	svc := &model.Service{Hostname: "foo.default.svc.cluster.local"}
+
+	e.InstancesByPort(svc, 80, nil)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected 1 request before caching, got %d", got)
+	}
+
+	e.InstancesByPort(svc, 80, nil)
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("expected cached response to avoid a second request, got %d requests", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	e.InstancesByPort(svc, 80, nil)
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Fatalf("expected a new request once the cache entry expired, got %d requests", got)
+	}
+}
+
+func TestHTTPExtenderRegistryCircuitBreakerIgnores404(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	e := NewHTTPExtenderRegistry(ExtenderConfig{ClusterID: "ext", URL: srv.URL})
+	for i := 0; i < defaultCircuitBreakThreshold+1; i++ {
+		if svc := e.GetService("foo.default.svc.cluster.local"); svc != nil {
+			t.Fatalf("GetService() = %v, want nil for a 404 response", svc)
+		}
+	}
+	if e.isCircuitOpen(kindService) {
+		t.Error("repeated 404s should not trip the circuit breaker")
+	}
+}
+
+func TestHTTPExtenderRegistryCircuitBreakerTripsOnFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	e := NewHTTPExtenderRegistry(ExtenderConfig{ClusterID: "ext", URL: srv.URL})
+	for i := 0; i < defaultCircuitBreakThreshold; i++ {
+		if svc := e.GetService("foo.default.svc.cluster.local"); svc != nil {
+			t.Fatalf("GetService() = %v, want nil for a 500 response", svc)
+		}
+	}
+	if !e.isCircuitOpen(kindService) {
+		t.Error("expected the circuit to be open after enough consecutive failures")
+	}
+
+	// Tripping the /service breaker must not affect unrelated endpoint kinds.
+	if e.isCircuitOpen(kindInstancesByProxy) {
+		t.Error("circuit breaker state must not be shared across endpoint kinds")
+	}
+}
+
+func TestHTTPExtenderRegistryGetServiceNullResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("null"))
+	}))
+	defer srv.Close()
+
+	e := NewHTTPExtenderRegistry(ExtenderConfig{ClusterID: "ext", URL: srv.URL})
+	if svc := e.GetService("foo.default.svc.cluster.local"); svc != nil {
+		t.Errorf("GetService() = %v, want nil for a null response body", svc)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"sort"
+	"sync"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/cluster"
+	"istio.io/istio/pkg/config/host"
+)
+
+// serviceIndex maintains a background-updated mapping from hostname and
+// cluster to the registries that serve them, so that GetService and
+// InstancesByPort can jump directly to the relevant registries instead of
+// scanning every registered one. It also caches the merged output of
+// Services(), invalidated whenever a member registry reports a change.
+//
+// The index is rebuilt wholesale whenever registry membership changes
+// (AddRegistry/DeleteRegistry) and updated incrementally as member registries
+// fire service-change events.
+type serviceIndex struct {
+	mu sync.RWMutex
+
+	byHost    map[host.Name][]*registryEntry
+	byCluster map[cluster.ID][]*registryEntry
+
+	snapshot      []*model.Service
+	snapshotValid bool
+
+	// generation guards against a rebuild that was started against an older
+	// registry list finishing after, and clobbering, one started against a
+	// newer list (see rebuild).
+	generation uint64
+}
+
+func newServiceIndex() *serviceIndex {
+	return &serviceIndex{
+		byHost:    make(map[host.Name][]*registryEntry),
+		byCluster: make(map[cluster.ID][]*registryEntry),
+	}
+}
+
+// rebuild recomputes the hostname and cluster indices from scratch by
+// listing services from every registry once. It is called whenever registry
+// membership changes (AddRegistry/DeleteRegistry); the cost is amortized
+// across all subsequent lookups until the next membership change.
+//
+// Callers must NOT hold Controller.registryListMutex (or any exclusive lock)
+// while calling this: registries (including HTTPExtenderRegistry) may block
+// on network I/O in Services(), and doing that under the exclusive lock
+// would stall every concurrent Services()/GetService()/
+// GetProxyServiceInstances() caller, which only need an RLock, for the sum of
+// every registry's response time. Pass a snapshot of the registry list
+// captured while the lock was briefly held instead.
+//
+// generation must be a monotonically increasing counter bumped under
+// registryListMutex each time the registry list is mutated, so that a rebuild
+// started against a stale (older) list can't clobber the result of a rebuild
+// started against a newer one if the two finish out of order.
+func (idx *serviceIndex) rebuild(registries []*registryEntry, generation uint64) {
+	byHost := make(map[host.Name][]*registryEntry)
+	byCluster := make(map[cluster.ID][]*registryEntry)
+	for _, r := range registries {
+		byCluster[r.Cluster()] = append(byCluster[r.Cluster()], r)
+		svcs, err := r.Services()
+		if err != nil {
+			scope.Warnf("serviceIndex rebuild: registry %s Services() failed: %v", r.Cluster(), err)
+			continue
+		}
+		for _, s := range svcs {
+			byHost[s.Hostname] = append(byHost[s.Hostname], r)
+		}
+	}
+	for hostname, regs := range byHost {
+		sortByWeightDesc(regs)
+		byHost[hostname] = regs
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if generation < idx.generation {
+		// A newer rebuild already landed; this one is stale, discard it.
+		return
+	}
+	idx.generation = generation
+	idx.byHost = byHost
+	idx.byCluster = byCluster
+	idx.snapshot = nil
+	idx.snapshotValid = false
+}
+
+// sortByWeightDesc orders regs by descending WeightedInstance.Weight(), with
+// registries that don't advertise a weight (the common case) treated as
+// weight 0 and kept in their relative registration order. Used so that, when
+// the same hostname is reported by more than one registry, higher-weight
+// registries (e.g. a preferred HTTPExtenderRegistry) are merged first.
+func sortByWeightDesc(regs []*registryEntry) {
+	sort.SliceStable(regs, func(i, j int) bool {
+		return instanceWeight(regs[i].Instance) > instanceWeight(regs[j].Instance)
+	})
+}
+
+// WeightedInstance is implemented by registries - such as HTTPExtenderRegistry
+// - that want to influence merge order when the same hostname is reported by
+// more than one registry; higher weight registries are consulted first.
+type WeightedInstance interface {
+	serviceregistry.Instance
+	Weight() int
+}
+
+// instanceWeight returns r's configured weight, or 0 if it doesn't advertise one.
+func instanceWeight(r serviceregistry.Instance) int {
+	if w, ok := r.(WeightedInstance); ok {
+		return w.Weight()
+	}
+	return 0
+}
+
+// onServiceEvent incrementally updates the hostname index and drops the
+// cached Services() snapshot in response to a service-change event reported
+// by registry r.
+func (idx *serviceIndex) onServiceEvent(r *registryEntry, svc *model.Service, event model.Event) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.snapshot = nil
+	idx.snapshotValid = false
+	if svc == nil {
+		return
+	}
+
+	switch event {
+	case model.EventDelete:
+		idx.removeLocked(svc.Hostname, r)
+	default:
+		idx.addLocked(svc.Hostname, r)
+	}
+}
+
+func (idx *serviceIndex) addLocked(hostname host.Name, r *registryEntry) {
+	for _, existing := range idx.byHost[hostname] {
+		if existing == r {
+			return
+		}
+	}
+	regs := append(idx.byHost[hostname], r)
+	sortByWeightDesc(regs)
+	idx.byHost[hostname] = regs
+}
+
+func (idx *serviceIndex) removeLocked(hostname host.Name, r *registryEntry) {
+	regs := idx.byHost[hostname]
+	for i, existing := range regs {
+		if existing == r {
+			idx.byHost[hostname] = append(regs[:i], regs[i+1:]...)
+			return
+		}
+	}
+}
+
+// registriesForHost returns a copy of the registries known to serve
+// hostname, or (nil, false) if the index has no record of it - callers
+// should fall back to scanning every registry in that case to stay correct.
+// The slice is always a copy, never the live one stored in idx.byHost: addLocked/
+// removeLocked mutate that backing array in place under idx.mu, and callers
+// range over the returned slice after releasing idx.mu, so handing out the
+// live slice would race with a concurrent addLocked/removeLocked.
+func (idx *serviceIndex) registriesForHost(hostname host.Name) ([]*registryEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	regs, ok := idx.byHost[hostname]
+	if !ok {
+		return nil, false
+	}
+	out := make([]*registryEntry, len(regs))
+	copy(out, regs)
+	return out, true
+}
+
+// getSnapshot returns a copy of the cached merged Services() result, if still
+// valid. Each returned *model.Service is a fresh DeepCopy, never the cached
+// instance itself: model.Service carries its own Mutex expressly so callers
+// can mutate it in place, and the cache is shared across every concurrent and
+// future Services() caller, so handing out the live cached pointers would let
+// one caller's mutation leak into all the others.
+func (idx *serviceIndex) getSnapshot() ([]*model.Service, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	if !idx.snapshotValid {
+		return nil, false
+	}
+	out := make([]*model.Service, len(idx.snapshot))
+	for i, s := range idx.snapshot {
+		out[i] = s.DeepCopy()
+	}
+	return out, true
+}
+
+// setSnapshot caches a private copy of services as the merged Services()
+// result until the next invalidation, so later mutation of the caller's
+// slice/services can't corrupt the cache.
+func (idx *serviceIndex) setSnapshot(services []*model.Service) {
+	cached := make([]*model.Service, len(services))
+	for i, s := range services {
+		cached[i] = s.DeepCopy()
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.snapshot = cached
+	idx.snapshotValid = true
+}
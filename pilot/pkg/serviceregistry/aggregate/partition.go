@@ -0,0 +1,88 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pilot/pkg/serviceregistry/provider"
+	"istio.io/istio/pkg/cluster"
+)
+
+// Partition identifies a tenant, admin partition, or VPC that a registry
+// belongs to, in addition to its ClusterID/ProviderID. It lets multi-tenant
+// Istio deployments host overlapping hostnames per tenant without
+// cross-tenant leakage, mirroring the partition scoping other service meshes
+// apply to DNS/node lookups.
+type Partition string
+
+// PartitionedInstance is implemented by registries that advertise a
+// Partition. Registries that don't implement it are treated as
+// unpartitioned, i.e. always searched regardless of the proxy's partition.
+type PartitionedInstance interface {
+	serviceregistry.Instance
+	Partition() Partition
+}
+
+// PartitionLabel is the proxy metadata label a proxy's partition scope is
+// derived from, following the topology.istio.io/* convention already used
+// for network and cluster topology labels.
+const PartitionLabel = "topology.istio.io/partition"
+
+// registryPartition returns r's partition, or "" if r does not advertise one.
+func registryPartition(r serviceregistry.Instance) Partition {
+	if p, ok := r.(PartitionedInstance); ok {
+		return p.Partition()
+	}
+	return ""
+}
+
+// proxyPartition derives node's partition scope from its metadata labels. An
+// empty result means "search all partitions".
+func proxyPartition(node *model.Proxy) Partition {
+	if node == nil || node.Metadata == nil {
+		return ""
+	}
+	return Partition(node.Metadata.Labels[PartitionLabel])
+}
+
+// skipSearchingRegistryForPartition reports whether r should be skipped
+// because its partition does not match nodePartition. An empty partition on
+// either side means "search all", and registries hosting external services
+// are always searched - the same carve-outs skipSearchingRegistryForProxy
+// applies for cluster scoping.
+func skipSearchingRegistryForPartition(nodePartition Partition, r serviceregistry.Instance) bool {
+	if nodePartition == "" {
+		return false
+	}
+	if r.Provider() == provider.External {
+		return false
+	}
+	rp := registryPartition(r)
+	if rp == "" {
+		return false
+	}
+	return rp != nodePartition
+}
+
+// skipSearchingRegistryForProxyAndPartition combines cluster- and
+// partition-based scoping: a registry is skipped if either
+// skipSearchingRegistryForProxy or skipSearchingRegistryForPartition says so.
+func skipSearchingRegistryForProxyAndPartition(nodeClusterID cluster.ID, nodePartition Partition, r serviceregistry.Instance) bool {
+	if skipSearchingRegistryForProxy(nodeClusterID, r) {
+		return true
+	}
+	return skipSearchingRegistryForPartition(nodePartition, r)
+}